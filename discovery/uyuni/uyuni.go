@@ -16,14 +16,18 @@ package uyuni
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/kolo/xmlrpc"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
 
@@ -40,18 +44,54 @@ const (
 
 // DefaultSDConfig is the default Uyuni SD configuration.
 var DefaultSDConfig = SDConfig{
-	RefreshInterval: model.Duration(1 * time.Minute),
+	HTTPClientConfig: config.DefaultHTTPClientConfig,
+	Entitlement:      monitoringEntitlementLabel,
+	BatchSize:        500,
+	MaxConcurrency:   4,
+	RefreshInterval:  model.Duration(1 * time.Minute),
 }
 
+var (
+	refreshDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "uyuni_sd_refresh_duration_seconds",
+		Help: "The duration of a Uyuni service discovery refresh, in seconds.",
+	})
+	apiCallsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "uyuni_sd_api_calls_total",
+		Help: "Number of calls made to the Uyuni API, partitioned by method and outcome.",
+	}, []string{"method", "outcome"})
+)
+
 func init() {
 	discovery.RegisterConfig(&SDConfig{})
+	prometheus.MustRegister(refreshDuration, apiCallsTotal)
 }
 
 // SDConfig is the configuration for Uyuni based service discovery.
 type SDConfig struct {
-	Host            string         `yaml:"host"`
-	User            string         `yaml:"username"`
-	Pass            config.Secret  `yaml:"password"`
+	Host             string                  `yaml:"host"`
+	User             string                  `yaml:"username"`
+	Pass             config.Secret           `yaml:"password"`
+	HTTPClientConfig config.HTTPClientConfig `yaml:",inline"`
+	// EnableHTTP allows the Uyuni host to be reached over plain HTTP instead of
+	// HTTPS. Disabled by default, since Uyuni credentials would otherwise be
+	// sent in the clear.
+	EnableHTTP bool `yaml:"enable_http,omitempty"`
+	// Entitlement is the system entitlement that a minion must have to be
+	// considered for monitoring, e.g. "monitoring_entitled".
+	Entitlement string `yaml:"entitlement,omitempty"`
+	// Groups, if non-empty, restricts discovery to systems that belong to one
+	// of the named system groups.
+	Groups []string `yaml:"groups,omitempty"`
+	// Exporters, if non-empty, restricts discovery to endpoints whose
+	// exporter name or formula matches one of the given values.
+	Exporters []string `yaml:"exporters,omitempty"`
+	// BatchSize is the number of systems looked up per XML-RPC call when
+	// fetching network and endpoint information.
+	BatchSize int `yaml:"batch_size,omitempty"`
+	// MaxConcurrency is the number of batches fetched concurrently during a
+	// refresh.
+	MaxConcurrency  int            `yaml:"max_concurrency,omitempty"`
 	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"`
 }
 
@@ -83,6 +123,13 @@ type Discovery struct {
 	interval time.Duration
 	sdConfig *SDConfig
 	logger   log.Logger
+
+	// mu guards rpcClient, ctxRT and token, which are lazily created on the
+	// first refresh and then reused across refreshes.
+	mu        sync.Mutex
+	rpcClient *xmlrpc.Client
+	ctxRT     *ctxRoundTripper
+	token     string
 }
 
 // Name returns the name of the Config.
@@ -114,7 +161,47 @@ func (c *SDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if c.RefreshInterval <= 0 {
 		return errors.New("Uyuni SD configuration requires RefreshInterval to be a positive integer")
 	}
-	return nil
+	if c.Entitlement == "" {
+		return errors.New("Uyuni SD configuration requires a non-empty entitlement")
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("Uyuni SD configuration requires BatchSize to be a positive integer")
+	}
+	if c.MaxConcurrency <= 0 {
+		return errors.New("Uyuni SD configuration requires MaxConcurrency to be a positive integer")
+	}
+	parsedURL, err := url.Parse(c.Host)
+	if err != nil {
+		return errors.Wrap(err, "Uyuni SD configuration host is not a valid URL")
+	}
+	if parsedURL.Scheme == "http" && !c.EnableHTTP {
+		return errors.New("Uyuni SD configuration host uses plain HTTP; set enable_http to true to allow this")
+	}
+	return c.HTTPClientConfig.Validate()
+}
+
+// ctxRoundTripper wraps a base transport and binds whatever request passes
+// through it to the context of the refresh currently in flight, so that a
+// cancelled refresh aborts its outstanding HTTP requests even though the
+// underlying xmlrpc.Client is reused across refreshes.
+type ctxRoundTripper struct {
+	base http.RoundTripper
+
+	mu  sync.Mutex
+	ctx context.Context
+}
+
+func (c *ctxRoundTripper) setContext(ctx context.Context) {
+	c.mu.Lock()
+	c.ctx = ctx
+	c.mu.Unlock()
+}
+
+func (c *ctxRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	ctx := c.ctx
+	c.mu.Unlock()
+	return c.base.RoundTrip(req.WithContext(ctx))
 }
 
 // Attempt to login in Uyuni Server and get an auth token
@@ -124,19 +211,188 @@ func login(rpcclient *xmlrpc.Client, user string, pass string) (string, error) {
 	return result, err
 }
 
-// Logout from Uyuni API
-func logout(rpcclient *xmlrpc.Client, token string) error {
-	err := rpcclient.Call("auth.logout", token, nil)
+// outcomeLabel returns the "outcome" label value to record for err.
+func outcomeLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// authFaultPhrases are the substrings (matched case-insensitively) that the
+// Uyuni XML-RPC API is known to return in a fault when a session token is
+// invalid or has expired. The list is intentionally specific rather than a
+// single generic keyword like "session", so that an unrelated server error
+// that merely mentions a session (e.g. a database-session error bubbling up
+// through the API) isn't mistaken for an expired auth token and doesn't
+// trigger a spurious extra login/retry.
+var authFaultPhrases = []string{
+	"invalid session",
+	"session expired",
+	"session terminated",
+	"authentication failed",
+}
+
+// isAuthFault reports whether err looks like the Uyuni API rejecting our
+// cached session token, in which case the caller should log in again and
+// retry rather than surface the error.
+func isAuthFault(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, phrase := range authFaultPhrases {
+		if strings.Contains(msg, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureClientLocked makes sure d.rpcClient is connected and d.token is a
+// valid session token, creating them on first use. d.mu must be held.
+func (d *Discovery) ensureClientLocked(ctx context.Context) error {
+	if d.rpcClient == nil {
+		apiURL := d.sdConfig.Host + uyuniXMLRPCAPIPath
+		if _, err := url.ParseRequestURI(apiURL); err != nil {
+			return errors.Wrap(err, "Uyuni Server URL is not valid")
+		}
+		rt, err := config.NewRoundTripperFromConfig(d.sdConfig.HTTPClientConfig, "uyuni_sd")
+		if err != nil {
+			return errors.Wrap(err, "unable to create Uyuni HTTP transport")
+		}
+		d.ctxRT = &ctxRoundTripper{base: rt}
+		rpcClient, err := xmlrpc.NewClient(apiURL, d.ctxRT)
+		if err != nil {
+			return err
+		}
+		d.rpcClient = rpcClient
+	}
+	d.ctxRT.setContext(ctx)
+
+	if d.token == "" {
+		token, err := login(d.rpcClient, d.sdConfig.User, string(d.sdConfig.Pass))
+		apiCallsTotal.WithLabelValues("auth.login", outcomeLabel(err)).Inc()
+		if err != nil {
+			return errors.Wrap(err, "unable to login to Uyuni API")
+		}
+		d.token = token
+	}
+	return nil
+}
+
+// clientAndToken returns the cached XML-RPC client and a valid session
+// token, creating or refreshing them under d.mu as needed. A needed
+// auth.login round-trip runs while the lock is held, so concurrent callers
+// wait for a single login; the lock is released before the caller makes
+// its own API call, so concurrent batches can have requests in flight at
+// the same time.
+func (d *Discovery) clientAndToken(ctx context.Context) (*xmlrpc.Client, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.ensureClientLocked(ctx); err != nil {
+		return nil, "", err
+	}
+	return d.rpcClient, d.token, nil
+}
+
+// invalidateToken clears the cached token, unless another goroutine already
+// refreshed it in the meantime.
+func (d *Discovery) invalidateToken(staleToken string) {
+	d.mu.Lock()
+	if d.token == staleToken {
+		d.token = ""
+	}
+	d.mu.Unlock()
+}
+
+// call invokes method on the cached XML-RPC client, passing the cached
+// session token ahead of args. On a fault that looks like an expired
+// session it logs in again once and retries, so that callers don't have to
+// special-case re-authentication. Only client/token bookkeeping and any
+// needed login are done under lock; the call of method itself runs
+// unlocked so that batches fetched by runBatched actually overlap on the
+// wire.
+func (d *Discovery) call(ctx context.Context, method string, args []interface{}, reply interface{}) error {
+	rpcClient, token, err := d.clientAndToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = rpcClient.Call(method, append([]interface{}{token}, args...), reply)
+	if isAuthFault(err) {
+		apiCallsTotal.WithLabelValues(method, outcomeLabel(err)).Inc()
+		d.invalidateToken(token)
+		rpcClient, token, err = d.clientAndToken(ctx)
+		if err != nil {
+			return err
+		}
+		err = rpcClient.Call(method, append([]interface{}{token}, args...), reply)
+	}
+	apiCallsTotal.WithLabelValues(method, outcomeLabel(err)).Inc()
 	return err
 }
 
-// Get the system groups information of monitored clients
-func getSystemGroupsInfoOfMonitoredClients(rpcclient *xmlrpc.Client, token string) (map[int][]systemGroupID, error) {
+// batchInts splits ids into chunks of at most size elements. A non-positive
+// size yields all of ids as a single chunk.
+func batchInts(ids []int, size int) [][]int {
+	if len(ids) == 0 {
+		return nil
+	}
+	if size <= 0 || len(ids) <= size {
+		return [][]int{ids}
+	}
+	batches := make([][]int, 0, (len(ids)+size-1)/size)
+	for len(ids) > size {
+		batches = append(batches, ids[:size:size])
+		ids = ids[size:]
+	}
+	return append(batches, ids)
+}
+
+// runBatched splits ids into batches of d.sdConfig.BatchSize and runs fn on
+// up to d.sdConfig.MaxConcurrency of them concurrently, stopping as soon as
+// ctx is cancelled. Errors from every failed batch are aggregated into a
+// single returned error.
+func (d *Discovery) runBatched(ctx context.Context, ids []int, fn func(ctx context.Context, batch []int) error) error {
+	sem := make(chan struct{}, d.sdConfig.MaxConcurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []string
+
+batches:
+	for _, batch := range batchInts(ids, d.sdConfig.BatchSize) {
+		select {
+		case <-ctx.Done():
+			break batches
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(batch []int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(ctx, batch); err != nil {
+				mu.Lock()
+				errs = append(errs, err.Error())
+				mu.Unlock()
+			}
+		}(batch)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errors.Errorf("uyuni SD batch errors: %s", strings.Join(errs, "; "))
+	}
+	return ctx.Err()
+}
+
+// Get the system groups information of monitored clients holding the configured entitlement
+func (d *Discovery) getSystemGroupsInfoOfMonitoredClients(ctx context.Context) (map[int][]systemGroupID, error) {
 	var systemGroupsInfos []struct {
 		SystemID     int             `xmlrpc:"id"`
 		SystemGroups []systemGroupID `xmlrpc:"system_groups"`
 	}
-	err := rpcclient.Call("system.listSystemGroupsForSystemsWithEntitlement", []interface{}{token, monitoringEntitlementLabel}, &systemGroupsInfos)
+	err := d.call(ctx, "system.listSystemGroupsForSystemsWithEntitlement", []interface{}{d.sdConfig.Entitlement}, &systemGroupsInfos)
 	if err != nil {
 		return nil, err
 	}
@@ -147,34 +403,104 @@ func getSystemGroupsInfoOfMonitoredClients(rpcclient *xmlrpc.Client, token strin
 	return result, nil
 }
 
-// GetSystemNetworkInfo lists client FQDNs.
-func getNetworkInformationForSystems(rpcclient *xmlrpc.Client, token string, systemIDs []int) (map[int]networkInfo, error) {
-	var networkInfos []networkInfo
-	err := rpcclient.Call("system.getNetworkForSystems", []interface{}{token, systemIDs}, &networkInfos)
-	if err != nil {
-		return nil, err
+// systemGroupMatches reports whether any of systemGroups is named in allowedGroups.
+// An empty allowedGroups allows every group.
+func systemGroupMatches(systemGroups []systemGroupID, allowedGroups []string) bool {
+	if len(allowedGroups) == 0 {
+		return true
 	}
+	for _, systemGroup := range systemGroups {
+		for _, allowedGroup := range allowedGroups {
+			if systemGroup.GroupName == allowedGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// formulaNameFromModule extracts the formula name embedded in a monitoring
+// endpoint's module, e.g. "node-exporter::default" yields "node-exporter".
+func formulaNameFromModule(module string) string {
+	if idx := strings.Index(module, "::"); idx != -1 {
+		return module[:idx]
+	}
+	return module
+}
+
+// labelNameInvalidChars matches runs of characters that cannot appear in a
+// Prometheus label name ([a-zA-Z0-9_]).
+var labelNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// sanitizeLabelComponent rewrites s, which may come from server-supplied
+// data, so that it is safe to append to a Prometheus label name: disallowed
+// characters become "_", and a leading digit is prefixed with "_" since
+// label names may not start with one.
+func sanitizeLabelComponent(s string) string {
+	s = labelNameInvalidChars.ReplaceAllString(s, "_")
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return s
+}
+
+// exporterAllowed reports whether endpoint should be kept given an allowlist
+// of exporter names/formulas. An empty allowedExporters allows every exporter.
+func exporterAllowed(endpoint endpointInfo, allowedExporters []string) bool {
+	if len(allowedExporters) == 0 {
+		return true
+	}
+	formula := formulaNameFromModule(endpoint.Module)
+	for _, allowedExporter := range allowedExporters {
+		if endpoint.ExporterName == allowedExporter || formula == allowedExporter {
+			return true
+		}
+	}
+	return false
+}
+
+// getNetworkInformationForSystems lists client FQDNs, fetching systemIDs in
+// concurrent batches.
+func (d *Discovery) getNetworkInformationForSystems(ctx context.Context, systemIDs []int) (map[int]networkInfo, error) {
 	result := make(map[int]networkInfo)
-	for _, networkInfo := range networkInfos {
-		result[networkInfo.SystemID] = networkInfo
+	var mu sync.Mutex
+	err := d.runBatched(ctx, systemIDs, func(ctx context.Context, batch []int) error {
+		var networkInfos []networkInfo
+		if err := d.call(ctx, "system.getNetworkForSystems", []interface{}{batch}, &networkInfos); err != nil {
+			return err
+		}
+		mu.Lock()
+		for _, info := range networkInfos {
+			result[info.SystemID] = info
+		}
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return result, nil
 }
 
-// Get endpoints information for given systems
-func getEndpointInfoForSystems(
-	rpcclient *xmlrpc.Client,
-	token string,
-	systemIDs []int,
-) ([]endpointInfo, error) {
-	var endpointInfos []endpointInfo
-	err := rpcclient.Call(
-		"system.monitoring.listEndpoints",
-		[]interface{}{token, systemIDs}, &endpointInfos)
+// getEndpointInfoForSystems gets endpoint information for systemIDs,
+// fetching them in concurrent batches.
+func (d *Discovery) getEndpointInfoForSystems(ctx context.Context, systemIDs []int) ([]endpointInfo, error) {
+	var result []endpointInfo
+	var mu sync.Mutex
+	err := d.runBatched(ctx, systemIDs, func(ctx context.Context, batch []int) error {
+		var endpointInfos []endpointInfo
+		if err := d.call(ctx, "system.monitoring.listEndpoints", []interface{}{batch}, &endpointInfos); err != nil {
+			return err
+		}
+		mu.Lock()
+		result = append(result, endpointInfos...)
+		mu.Unlock()
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	return endpointInfos, err
+	return result, nil
 }
 
 // NewDiscovery returns a uyuni discovery for the given configuration.
@@ -217,6 +543,7 @@ func (d *Discovery) getEndpointLabels(
 		model.AddressLabel:                       model.LabelValue(addr),
 		uyuniMetaLabelPrefix + "minion_hostname": model.LabelValue(hostname),
 		uyuniMetaLabelPrefix + "system_id":       model.LabelValue(fmt.Sprintf("%d", endpoint.SystemID)),
+		uyuniMetaLabelPrefix + "entitlement":     model.LabelValue(d.sdConfig.Entitlement),
 	}
 
 	if len(managedGroupNames) > 0 {
@@ -230,6 +557,9 @@ func (d *Discovery) getEndpointLabels(
 	}
 	if len(endpoint.Module) > 0 {
 		result[uyuniMetaLabelPrefix+"proxy_module"] = model.LabelValue(endpoint.Module)
+		if formula := sanitizeLabelComponent(formulaNameFromModule(endpoint.Module)); formula != "" {
+			result[model.LabelName(uyuniMetaLabelPrefix+"formula_"+formula)] = "true"
+		}
 	}
 	if len(endpoint.Path) > 0 {
 		result[uyuniMetaLabelPrefix+"metrics_path"] = model.LabelValue(endpoint.Path)
@@ -252,8 +582,7 @@ func getSystemGroupNames(systemGroupsIDs []systemGroupID) []string {
 }
 
 func (d *Discovery) getTargetsForSystems(
-	rpcClient *xmlrpc.Client,
-	token string,
+	ctx context.Context,
 	systemGroupIDsBySystemID map[int][]systemGroupID,
 ) ([]model.LabelSet, error) {
 
@@ -264,18 +593,21 @@ func (d *Discovery) getTargetsForSystems(
 		systemIDs = append(systemIDs, systemID)
 	}
 
-	endpointInfos, err := getEndpointInfoForSystems(rpcClient, token, systemIDs)
+	endpointInfos, err := d.getEndpointInfoForSystems(ctx, systemIDs)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to get endpoints information")
 	}
 
-	networkInfoBySystemID, err := getNetworkInformationForSystems(rpcClient, token, systemIDs)
+	networkInfoBySystemID, err := d.getNetworkInformationForSystems(ctx, systemIDs)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to get the systems network information")
 	}
 
 	for _, endpoint := range endpointInfos {
 		systemID := endpoint.SystemID
+		if !exporterAllowed(endpoint, d.sdConfig.Exporters) {
+			continue
+		}
 		labels := d.getEndpointLabels(
 			endpoint,
 			systemGroupIDsBySystemID[systemID],
@@ -296,40 +628,22 @@ func (d *Discovery) getTargetsForSystems(
 
 func (d *Discovery) refresh(ctx context.Context) ([]*targetgroup.Group, error) {
 	cfg := d.sdConfig
-	apiURL := cfg.Host + uyuniXMLRPCAPIPath
-
 	startTime := time.Now()
+	defer func() { refreshDuration.Observe(time.Since(startTime).Seconds()) }()
 
-	// Check if the URL is valid and create rpc client
-	_, err := url.ParseRequestURI(apiURL)
-	if err != nil {
-		return nil, errors.Wrap(err, "Uyuni Server URL is not valid")
-	}
-
-	rpcClient, err := xmlrpc.NewClient(apiURL, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer rpcClient.Close()
-
-	token, err := login(rpcClient, cfg.User, string(cfg.Pass))
+	systemGroupIDsBySystemID, err := d.getSystemGroupsInfoOfMonitoredClients(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to login to Uyuni API")
+		return nil, errors.Wrap(err, "unable to get the managed system groups information of monitored clients")
 	}
-	defer func() {
-		if err := logout(rpcClient, token); err != nil {
-			level.Warn(d.logger).Log("msg", "Failed to log out from Uyuni API", "err", err)
+	for systemID, systemGroups := range systemGroupIDsBySystemID {
+		if !systemGroupMatches(systemGroups, cfg.Groups) {
+			delete(systemGroupIDsBySystemID, systemID)
 		}
-	}()
-
-	systemGroupIDsBySystemID, err := getSystemGroupsInfoOfMonitoredClients(rpcClient, token)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to get the managed system groups information of monitored clients")
 	}
 
 	targets := make([]model.LabelSet, 0)
 	if len(systemGroupIDsBySystemID) > 0 {
-		targetsForSystems, err := d.getTargetsForSystems(rpcClient, token, systemGroupIDsBySystemID)
+		targetsForSystems, err := d.getTargetsForSystems(ctx, systemGroupIDsBySystemID)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,357 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uyuni
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/common/config"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestSystemGroupMatches(t *testing.T) {
+	groups := []systemGroupID{
+		{GroupID: 1, GroupName: "web"},
+		{GroupID: 2, GroupName: "db"},
+	}
+
+	for _, tc := range []struct {
+		name          string
+		systemGroups  []systemGroupID
+		allowedGroups []string
+		want          bool
+	}{
+		{"no allowlist allows anything", groups, nil, true},
+		{"no allowlist allows no groups", nil, nil, true},
+		{"match", groups, []string{"db"}, true},
+		{"no match", groups, []string{"storage"}, false},
+		{"system has no groups", nil, []string{"db"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, systemGroupMatches(tc.systemGroups, tc.allowedGroups))
+		})
+	}
+}
+
+func TestExporterAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		endpoint         endpointInfo
+		allowedExporters []string
+		want             bool
+	}{
+		{
+			name:     "no allowlist allows anything",
+			endpoint: endpointInfo{ExporterName: "node_exporter"},
+			want:     true,
+		},
+		{
+			name:             "match by exporter name",
+			endpoint:         endpointInfo{ExporterName: "node_exporter"},
+			allowedExporters: []string{"node_exporter"},
+			want:             true,
+		},
+		{
+			name:             "match by formula embedded in module",
+			endpoint:         endpointInfo{Module: "postgres_exporter::default"},
+			allowedExporters: []string{"postgres_exporter"},
+			want:             true,
+		},
+		{
+			name:             "no match",
+			endpoint:         endpointInfo{ExporterName: "node_exporter", Module: "node_exporter::default"},
+			allowedExporters: []string{"apache_exporter"},
+			want:             false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, exporterAllowed(tc.endpoint, tc.allowedExporters))
+		})
+	}
+}
+
+func TestFormulaNameFromModule(t *testing.T) {
+	for _, tc := range []struct {
+		module string
+		want   string
+	}{
+		{"node-exporter::default", "node-exporter"},
+		{"postgres_exporter", "postgres_exporter"},
+		{"::default", ""},
+		{"", ""},
+	} {
+		t.Run(tc.module, func(t *testing.T) {
+			require.Equal(t, tc.want, formulaNameFromModule(tc.module))
+		})
+	}
+}
+
+func TestSanitizeLabelComponent(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"node-exporter", "node_exporter"},
+		{"node_exporter", "node_exporter"},
+		{"9lives", "_9lives"},
+		{"weird.name/v2", "weird_name_v2"},
+		{"", ""},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			require.Equal(t, tc.want, sanitizeLabelComponent(tc.in))
+		})
+	}
+}
+
+func TestSDConfigUnmarshalYAML(t *testing.T) {
+	const base = "host: https://uyuni.example.com\nusername: admin\npassword: secret\n"
+
+	for _, tc := range []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name: "valid https config",
+			yaml: base,
+		},
+		{
+			name:    "plain http host is rejected by default",
+			yaml:    "host: http://uyuni.example.com\nusername: admin\npassword: secret\n",
+			wantErr: "plain HTTP",
+		},
+		{
+			name: "plain http host is accepted with enable_http",
+			yaml: "host: http://uyuni.example.com\nusername: admin\npassword: secret\nenable_http: true\n",
+		},
+		{
+			name: "https host is accepted regardless of enable_http",
+			yaml: base + "enable_http: false\n",
+		},
+		{
+			name:    "empty entitlement is rejected",
+			yaml:    base + "entitlement: \"\"\n",
+			wantErr: "entitlement",
+		},
+		{
+			name:    "zero batch_size is rejected",
+			yaml:    base + "batch_size: 0\n",
+			wantErr: "BatchSize",
+		},
+		{
+			name:    "negative max_concurrency is rejected",
+			yaml:    base + "max_concurrency: -1\n",
+			wantErr: "MaxConcurrency",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var c SDConfig
+			err := yaml.Unmarshal([]byte(tc.yaml), &c)
+			if tc.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestBatchInts(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ids  []int
+		size int
+		want [][]int
+	}{
+		{"empty", nil, 2, nil},
+		{"smaller than batch", []int{1, 2}, 5, [][]int{{1, 2}}},
+		{"exact multiple", []int{1, 2, 3, 4}, 2, [][]int{{1, 2}, {3, 4}}},
+		{"remainder", []int{1, 2, 3, 4, 5}, 2, [][]int{{1, 2}, {3, 4}, {5}}},
+		{"non-positive size returns a single batch", []int{1, 2, 3}, 0, [][]int{{1, 2, 3}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, batchInts(tc.ids, tc.size))
+		})
+	}
+}
+
+func TestRunBatched(t *testing.T) {
+	t.Run("aggregates results across concurrent batches", func(t *testing.T) {
+		d := &Discovery{sdConfig: &SDConfig{BatchSize: 2, MaxConcurrency: 3}}
+
+		var mu sync.Mutex
+		var seen []int
+		err := d.runBatched(context.Background(), []int{1, 2, 3, 4, 5}, func(ctx context.Context, batch []int) error {
+			mu.Lock()
+			seen = append(seen, batch...)
+			mu.Unlock()
+			return nil
+		})
+		require.NoError(t, err)
+		sort.Ints(seen)
+		require.Equal(t, []int{1, 2, 3, 4, 5}, seen)
+	})
+
+	t.Run("aggregates errors from failing batches", func(t *testing.T) {
+		d := &Discovery{sdConfig: &SDConfig{BatchSize: 1, MaxConcurrency: 2}}
+
+		err := d.runBatched(context.Background(), []int{1, 2}, func(ctx context.Context, batch []int) error {
+			return fmt.Errorf("batch %v failed", batch)
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("returns the context error when cancelled", func(t *testing.T) {
+		d := &Discovery{sdConfig: &SDConfig{BatchSize: 1, MaxConcurrency: 1}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := d.runBatched(ctx, []int{1, 2, 3}, func(ctx context.Context, batch []int) error {
+			return nil
+		})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestIsAuthFault(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil error", nil, false},
+		{"unrelated error", fmt.Errorf("connection refused"), false},
+		{"invalid session", fmt.Errorf("API Fault: invalid session"), true},
+		{"session expired", fmt.Errorf("Invalid session key or session expired"), true},
+		{"session terminated", fmt.Errorf("Session terminated, please sign in again"), true},
+		{"authentication failed", fmt.Errorf("Authentication failed for user"), true},
+		{
+			name: "unrelated error mentioning session is not mistaken for an expired token",
+			err:  fmt.Errorf("database session error: too many open sessions"),
+			want: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, isAuthFault(tc.err))
+		})
+	}
+}
+
+// xmlRPCMethodNameRE and xmlRPCFirstStringRE do just enough ad hoc parsing
+// of an XML-RPC request body to drive the fake server below, without
+// pulling in a full XML-RPC server implementation.
+var (
+	xmlRPCMethodNameRE  = regexp.MustCompile(`<methodName>([^<]*)</methodName>`)
+	xmlRPCFirstStringRE = regexp.MustCompile(`<string>([^<]*)</string>`)
+)
+
+func xmlRPCMethodName(body []byte) string {
+	m := xmlRPCMethodNameRE.FindSubmatch(body)
+	if m == nil {
+		return ""
+	}
+	return string(m[1])
+}
+
+func xmlRPCFirstString(body []byte) string {
+	m := xmlRPCFirstStringRE.FindSubmatch(body)
+	if m == nil {
+		return ""
+	}
+	return string(m[1])
+}
+
+func xmlRPCStringResponse(s string) string {
+	return `<?xml version="1.0"?><methodResponse><params><param><value><string>` + s + `</string></value></param></params></methodResponse>`
+}
+
+func xmlRPCFaultResponse(code int, message string) string {
+	return fmt.Sprintf(`<?xml version="1.0"?><methodResponse><fault><value><struct>`+
+		`<member><name>faultCode</name><value><int>%d</int></value></member>`+
+		`<member><name>faultString</name><value><string>%s</string></value></member>`+
+		`</struct></value></fault></methodResponse>`, code, message)
+}
+
+// TestDiscoveryCallRetriesOnAuthFault drives Discovery.call against a fake
+// XML-RPC server to exercise the cached-client/cached-token re-login path:
+// the first call's session is rejected, and call is expected to log in
+// again and retry before giving up.
+func TestDiscoveryCallRetriesOnAuthFault(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		loginCount int
+		validToken string
+		failNext   = true
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "text/xml")
+
+		switch xmlRPCMethodName(body) {
+		case "auth.login":
+			mu.Lock()
+			loginCount++
+			validToken = fmt.Sprintf("token-%d", loginCount)
+			token := validToken
+			mu.Unlock()
+			fmt.Fprint(w, xmlRPCStringResponse(token))
+		case "dummy.method":
+			token := xmlRPCFirstString(body)
+			mu.Lock()
+			shouldFail := failNext
+			failNext = false
+			current := validToken
+			mu.Unlock()
+			if shouldFail || token != current {
+				fmt.Fprint(w, xmlRPCFaultResponse(2950, "invalid session"))
+				return
+			}
+			fmt.Fprint(w, xmlRPCStringResponse("ok"))
+		default:
+			t.Errorf("unexpected XML-RPC method call: %s", body)
+		}
+	}))
+	defer server.Close()
+
+	d := &Discovery{
+		sdConfig: &SDConfig{
+			Host:             server.URL,
+			User:             "user",
+			Pass:             "pass",
+			HTTPClientConfig: config.DefaultHTTPClientConfig,
+		},
+	}
+
+	var reply string
+	err := d.call(context.Background(), "dummy.method", nil, &reply)
+	require.NoError(t, err)
+	require.Equal(t, "ok", reply)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 2, loginCount, "expected a re-login after the simulated expired-session fault")
+}